@@ -2,12 +2,14 @@ package bplustree
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
 var (
-	ErrNotFound       = errors.New("Not found")
-	ErrNotImplemented = errors.New("Not implemented")
+	ErrNotFound            = errors.New("Not found")
+	ErrNotImplemented      = errors.New("Not implemented")
+	ErrIteratorInvalidated = errors.New("Iterator invalidated by a concurrent mutation")
 )
 
 const (
@@ -27,11 +29,84 @@ type BTree interface {
 	NodeCount() uint64
 	Insert(value interface{}) (BTreeKey, error)
 	Update(key BTreeKey, value interface{}) error
+	Upsert(value interface{}) (BTreeKey, bool, error)
 	Delete(key BTreeKey) error
 	Search(key BTreeKey) (interface{}, error)
+	Seek(key BTreeKey) Iterator
+	SeekFirst() Iterator
+	SeekLast() Iterator
+	Range(lo, hi BTreeKey) Iterator
+	Min() (BTreeKey, interface{}, error)
+	Max() (BTreeKey, interface{}, error)
+	Snapshot() Snapshot
+	Close() error
 }
 
-func NewBTree(degree uint16, keyGenerator BTreeKeyGenerator, keyCompare BTreeKeyCompare) BTree {
+// Snapshot is an immutable view of a BTree pinned to the state at the
+// moment Snapshot() was called. Subsequent Insert/Update/Upsert/Delete
+// calls copy-on-write the nodes they touch instead of mutating them in
+// place, so a Snapshot's view never changes underneath it. Call Release
+// once done so the tree can stop preserving that version's nodes.
+type Snapshot interface {
+	Search(key BTreeKey) (interface{}, error)
+	Seek(key BTreeKey) Iterator
+	SeekFirst() Iterator
+	SeekLast() Iterator
+	Range(lo, hi BTreeKey) Iterator
+	Min() (BTreeKey, interface{}, error)
+	Max() (BTreeKey, interface{}, error)
+	Release()
+}
+
+// Iterator walks a BTree's entries in key order. It is obtained from Seek,
+// SeekFirst, SeekLast or Range and must be closed once the caller is done
+// with it.
+//
+// Iterators do not see a fully isolated snapshot: they are invalidated by
+// any mutation (Insert/Update/Upsert/Delete) that commits after the
+// iterator was created, since the tree only tracks one version at a time.
+// A mutation mid-scan causes the next Next() to return false with Err()
+// reporting ErrIteratorInvalidated, regardless of whether the mutation
+// actually touched the range being scanned.
+type Iterator interface {
+	Next() bool
+	Key() BTreeKey
+	Value() interface{}
+	Err() error
+	Close() error
+}
+
+// Option configures optional NewBTree behaviour, such as wiring up a
+// persistence layer.
+type Option func(*tree)
+
+// WithStorage backs the tree with a Storage implementation so houseKeeping
+// can write dirty nodes out and evict cold ones instead of keeping the
+// whole tree resident in RAM. Requires WithCodec (or defaults to gob).
+func WithStorage(storage Storage) Option {
+	return func(t *tree) {
+		t.storage = storage
+	}
+}
+
+// WithCodec supplies the Codec used to marshal keys/values when a Storage
+// is configured. Defaults to a gob-based codec if omitted.
+func WithCodec(codec Codec) Option {
+	return func(t *tree) {
+		t.codec = codec
+	}
+}
+
+// WithCacheSize overrides the number of leaf nodes houseKeeping keeps
+// resident before evicting the coldest ones. Only meaningful alongside
+// WithStorage; defaults to defaultNodeCacheSize.
+func WithCacheSize(size int) Option {
+	return func(t *tree) {
+		t.cacheSize = size
+	}
+}
+
+func NewBTree(degree uint16, keyGenerator BTreeKeyGenerator, keyCompare BTreeKeyCompare, opts ...Option) BTree {
 	tree := new(tree)
 
 	if degree < MIN_DEGREE {
@@ -39,69 +114,164 @@ func NewBTree(degree uint16, keyGenerator BTreeKeyGenerator, keyCompare BTreeKey
 	}
 
 	tree.degree = degree
-	tree.root = tree.newTreeNode(true)
 	tree.keyCompare = keyCompare
 	tree.keyGenerator = keyGenerator
-	tree.commandQueue = make(chan func())
-	tree.stop = make(chan struct{})
+	tree.stopCh = make(chan struct{})
+	tree.refs = make(map[uint64]int)
 
-	go tree.processCommands()
+	for _, opt := range opts {
+		opt(tree)
+	}
+
+	if tree.storage != nil {
+		if tree.codec == nil {
+			tree.codec = NewGobCodec()
+		}
+		if tree.cacheSize <= 0 {
+			tree.cacheSize = defaultNodeCacheSize
+		}
+		tree.cache = newNodeCache(tree.cacheSize)
+		tree.root = tree.loadOrCreateRoot()
+	} else {
+		tree.root = tree.newTreeNode(true)
+	}
+
+	go tree.runHouseKeeping()
 
 	return tree
 }
 
 func (t *tree) Insert(value interface{}) (BTreeKey, error) {
-	ch := make(chan *bTreeTriple)
-
-	t.commandQueue <- func() {
-		t.insert(value, ch)
-	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	triple := <-ch
+	triple := t.insert(value)
 
 	return triple.key, triple.err
 }
 
 func (t *tree) Update(key BTreeKey, value interface{}) error {
-	ch := make(chan *bTreeTriple)
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	t.commandQueue <- func() {
-		t.update(key, value, ch)
-	}
-
-	triple := <-ch
+	triple := t.update(key, value)
 
 	return triple.err
 }
 
-func (t *tree) Delete(key BTreeKey) error {
-	ch := make(chan *bTreeTriple)
+func (t *tree) Upsert(value interface{}) (BTreeKey, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	t.commandQueue <- func() {
-		t.delete(key, ch)
-	}
+	triple := t.upsert(value)
 
-	triple := <-ch
+	return triple.key, triple.updated, triple.err
+}
+
+func (t *tree) Delete(key BTreeKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	triple := t.delete(key)
 
 	return triple.err
 }
 
 func (t *tree) Search(key BTreeKey) (interface{}, error) {
-	ch := make(chan *bTreeTriple)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	triple := t.search(key)
+
+	return triple.value, triple.err
+}
+
+func (t *tree) Seek(key BTreeKey) Iterator {
+	return t.newIterator(false, key, true, nil, false)
+}
 
-	t.commandQueue <- func() {
-		t.search(key, ch)
+func (t *tree) SeekFirst() Iterator {
+	return t.newIterator(false, nil, false, nil, false)
+}
+
+func (t *tree) SeekLast() Iterator {
+	return t.newIterator(true, nil, false, nil, false)
+}
+
+func (t *tree) Range(lo, hi BTreeKey) Iterator {
+	return t.newIterator(false, lo, true, hi, true)
+}
+
+func (t *tree) Min() (BTreeKey, interface{}, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, err := t.leftmostLeaf()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.keys) == 0 {
+		return nil, nil, ErrNotFound
 	}
 
-	triple := <-ch
+	return leaf.keys[0], leaf.values[0], nil
+}
 
-	return triple.value, triple.err
+func (t *tree) Max() (BTreeKey, interface{}, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, err := t.rightmostLeaf()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.keys) == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	last := len(leaf.keys) - 1
+	return leaf.keys[last], leaf.values[last], nil
 }
 
 func (t *tree) NodeCount() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	return t.nodeCount
 }
 
+// Snapshot pins the tree's current root so later mutations can't disturb
+// it. See cowEnabled/cowNode for how that pin is honoured.
+func (t *tree) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refs[t.version] += 1
+
+	return &treeSnapshot{t: t, version: t.version, root: t.root}
+}
+
+// Close flushes any dirty nodes to Storage (a no-op when none is
+// configured) and stops the background houseKeeping ticker. The tree must
+// not be used afterwards.
+func (t *tree) Close() error {
+	t.mu.Lock()
+	t.houseKeeping()
+	t.mu.Unlock()
+
+	close(t.stopCh)
+
+	return nil
+}
+
+// tree guards its structure with mu: mutations (Insert/Update/Upsert/Delete,
+// and anything else that can change node contents or topology) take the
+// write lock, while Search, Range and Snapshot reads take the read lock so
+// they can proceed concurrently with each other. cacheMu is a second, much
+// narrower lock that only serializes the node cache bookkeeping and lazy
+// Storage loads performed by child()/findNodeForKey while readers hold mu
+// for reading -- mutations already have mu held exclusively, so they never
+// need it.
 type tree struct {
 	nodeCount    uint64
 	degree       uint16
@@ -109,13 +279,40 @@ type tree struct {
 	keyCompare   BTreeKeyCompare
 	keyGenerator BTreeKeyGenerator
 	dirty        bool
-	commandQueue chan func()
-	stop         chan struct{}
+	version      uint64
+	mu           sync.RWMutex
+	cacheMu      sync.Mutex
+	stopCh       chan struct{}
+	storage      Storage
+	codec        Codec
+	cache        *nodeCache
+	cacheSize    int
+	refs         map[uint64]int
+	orphaned     []orphan
+}
+
+// orphan records a single node that copy-on-write cloning replaced and
+// detached from the live tree (see cowNode). It remains reachable only
+// from whichever pinned Snapshots took their root at a version in
+// [minVersion, atVersion]: minVersion is when the node became live,
+// atVersion is the tree version at which it was cloned away. Once
+// no currently-pinned Snapshot falls in that range, reclaimOrphans frees
+// it from Storage.
+type orphan struct {
+	root       *treeNode
+	minVersion uint64
+	atVersion  uint64
 }
 
 // For leaf nodes, key[idx] -> value[idx]
 // For internal nodes children[idx] is a node that has keys less than key[idx]
 // For internal nodes, note that len(children) > len(keys)
+//
+// When a Storage is configured, children may be lazily unloaded: children[idx]
+// is nil and childIDs[idx] holds the id needed to fetch it back. Leaf
+// next/previous pointers are best-effort once Storage is involved -- they're
+// only reconnected on load if the neighbouring leaf happens to already be
+// resident, so nextID/prevID are kept as the durable source of truth.
 type treeNode struct {
 	internalID uint64
 	dirty      bool
@@ -123,98 +320,963 @@ type treeNode struct {
 	keys       []BTreeKey
 	values     []interface{}
 	children   []*treeNode
+	childIDs   []uint64
 	parent     *treeNode
 	previous   *treeNode
 	next       *treeNode
+	nextID     uint64
+	prevID     uint64
+
+	// owner is the tree version this node became part of the live tree at
+	// (see cowNode/needsCOW): either when it was created, or when it was
+	// last copy-on-write cloned away from an older node.
+	owner uint64
 }
 
 type bTreeTriple struct {
-	key   BTreeKey
-	value interface{}
-	err   error
+	key     BTreeKey
+	value   interface{}
+	updated bool
+	err     error
 }
 
-func (t *tree) processCommands() {
-	timer := time.Tick(time.Second * 5)
-	running := true
-	for running {
+// runHouseKeeping periodically flushes and evicts on a timer, replacing
+// the single command goroutine that used to interleave this with every
+// other operation. It runs houseKeeping under the write lock so it can't
+// race a concurrent Insert/Update/Upsert/Delete, but it no longer sits in
+// between reads, which can now run concurrently with each other.
+func (t *tree) runHouseKeeping() {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case <-t.stop:
-			running = false
-		case command := <-t.commandQueue:
-			command()
-		case <-timer:
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+			t.mu.Lock()
 			t.houseKeeping()
+			t.mu.Unlock()
 		}
 	}
-
-	t.houseKeeping()
 }
 
-func (t *tree) insert(value interface{}, channel chan *bTreeTriple) {
+func (t *tree) insert(value interface{}) *bTreeTriple {
 	triple := new(bTreeTriple)
 
 	if key, err := t.keyGenerator(t, value); err != nil {
 		triple.err = err
+	} else if n, err := t.cowFindNodeForKey(key); err != nil {
+		triple.err = err
 	} else {
-		n := t.findNodeForKey(key)
 		t.recordValue(key, value, n)
 		triple.key = key
+		t.version += 1
 	}
 
-	channel <- triple
+	return triple
 }
 
-func (t *tree) update(key BTreeKey, value interface{}, channel chan *bTreeTriple) {
-	channel <- &bTreeTriple{
-		err: ErrNotImplemented,
+func (t *tree) update(key BTreeKey, value interface{}) *bTreeTriple {
+	triple := new(bTreeTriple)
+
+	n, err := t.cowFindNodeForKey(key)
+	if err != nil {
+		triple.err = err
+		return triple
 	}
-}
 
-func (t *tree) delete(key BTreeKey, channel chan *bTreeTriple) {
-	channel <- &bTreeTriple{
-		err: ErrNotImplemented,
+	idx := t.findKeyIndex(n, key)
+	if idx == -1 {
+		triple.err = ErrNotFound
+	} else {
+		n.values[idx] = value
+		triple.key = key
+		t.version += 1
 	}
+
+	return triple
 }
 
-func (t *tree) search(key BTreeKey, channel chan *bTreeTriple) {
+func (t *tree) upsert(value interface{}) *bTreeTriple {
 	triple := new(bTreeTriple)
-	node := t.findNodeForKey(key)
 
-	triple.err = ErrNotFound
+	key, err := t.keyGenerator(t, value)
+	if err != nil {
+		triple.err = err
+		return triple
+	}
+
+	n, err := t.cowFindNodeForKey(key)
+	if err != nil {
+		triple.err = err
+		return triple
+	}
 
-	for idx, k := range node.keys {
+	if idx := t.findKeyIndex(n, key); idx != -1 {
+		n.values[idx] = value
+		triple.updated = true
+	} else {
+		t.recordValue(key, value, n)
+	}
+
+	triple.key = key
+	t.version += 1
+
+	return triple
+}
+
+// findKeyIndex returns the position of key within leaf n's keys, or -1 if
+// it isn't present.
+func (t *tree) findKeyIndex(n *treeNode, key BTreeKey) int {
+	for idx, k := range n.keys {
 		if t.keyCompare(key, k) == OrderedSame {
-			triple.value = node.values[idx]
-			triple.err = nil
-			break
+			return idx
 		}
 	}
 
-	channel <- triple
+	return -1
+}
+
+func (t *tree) delete(key BTreeKey) *bTreeTriple {
+	triple := new(bTreeTriple)
+
+	n, err := t.cowFindNodeForKey(key)
+	if err != nil {
+		triple.err = err
+		return triple
+	}
+
+	idx := t.findKeyIndex(n, key)
+	if idx == -1 {
+		triple.err = ErrNotFound
+		return triple
+	}
+
+	n.keys = append(n.keys[:idx], n.keys[idx+1:]...)
+	n.values = append(n.values[:idx], n.values[idx+1:]...)
+
+	if idx == 0 && len(n.keys) > 0 {
+		t.propagateSeparatorUpdate(n, key, n.keys[0])
+	}
+
+	// The key is already gone from n regardless of what happens next, so
+	// the mutation still counts even if rebalance can't finish: report its
+	// error but still advance the version, the same way a torn write is
+	// still a write.
+	triple.err = t.rebalance(n)
+	t.version += 1
+
+	return triple
+}
+
+// minKeys returns the fewest keys a non-root node may hold before it is
+// considered underflowed, mirroring the leaf-vs-internal degree distinction
+// splitNode already uses.
+func (t *tree) minKeys(n *treeNode) int {
+	degree := int(t.degree)
+	if n.leaf {
+		degree -= 1
+	}
+
+	min := (degree+1)/2 - 1
+	if min < 1 {
+		min = 1
+	}
+
+	return min
+}
+
+func (t *tree) childIndex(parent, child *treeNode) int {
+	for idx, c := range parent.children {
+		if c == child {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// propagateSeparatorUpdate fixes up the routing key an ancestor uses to
+// reach n after n's smallest key changes, e.g. because it was just deleted.
+func (t *tree) propagateSeparatorUpdate(n *treeNode, oldKey, newKey BTreeKey) {
+	child := n
+	parent := n.parent
+
+	for parent != nil {
+		idx := t.childIndex(parent, child)
+		if idx > 0 && t.keyCompare(parent.keys[idx-1], oldKey) == OrderedSame {
+			parent.keys[idx-1] = newKey
+			return
+		}
+
+		child = parent
+		parent = parent.parent
+	}
 }
 
-func (t *tree) findNodeForKey(key BTreeKey) *treeNode {
+// rebalance restores the minimum-occupancy invariant for n after a
+// deletion, borrowing from a sibling when one has spare keys, merging with
+// a sibling otherwise, and collapsing the root when it is left with a
+// single child. It can return an error if reaching a sibling or child
+// required a lazy Storage load that failed.
+func (t *tree) rebalance(n *treeNode) error {
+	if n == t.root {
+		if !n.leaf && len(n.children) == 1 {
+			oldRoot := n
+			newRoot, err := t.child(n, 0)
+			if err != nil {
+				return err
+			}
+			t.root = newRoot
+			t.root.parent = nil
+
+			if t.cache != nil {
+				t.cache.forget(oldRoot.internalID)
+			}
+			if t.storage != nil {
+				t.storage.DeleteNode(oldRoot.internalID)
+			}
+		}
+		return nil
+	}
+
+	if len(n.keys) >= t.minKeys(n) {
+		return nil
+	}
+
+	parent := n.parent
+	idx := t.childIndex(parent, n)
+
+	if idx > 0 {
+		left, err := t.child(parent, idx-1)
+		if err != nil {
+			return err
+		}
+		if len(left.keys) > t.minKeys(left) {
+			return t.borrowFromLeftSibling(n, parent, idx)
+		}
+	}
+
+	if idx < len(parent.children)-1 {
+		right, err := t.child(parent, idx+1)
+		if err != nil {
+			return err
+		}
+		if len(right.keys) > t.minKeys(right) {
+			return t.borrowFromRightSibling(n, parent, idx)
+		}
+	}
+
+	if idx > 0 {
+		left, err := t.cowChild(parent, idx-1)
+		if err != nil {
+			return err
+		}
+		t.mergeSiblings(left, n, parent, idx-1)
+	} else {
+		right, err := t.cowChild(parent, idx+1)
+		if err != nil {
+			return err
+		}
+		t.mergeSiblings(n, right, parent, idx)
+	}
+
+	return t.rebalance(parent)
+}
+
+func (t *tree) borrowFromLeftSibling(n, parent *treeNode, idx int) error {
+	left, err := t.cowChild(parent, idx-1)
+	if err != nil {
+		return err
+	}
+	lastKeyIdx := len(left.keys) - 1
+
+	if n.leaf {
+		lastValueIdx := len(left.values) - 1
+		key := left.keys[lastKeyIdx]
+		value := left.values[lastValueIdx]
+
+		left.keys = left.keys[:lastKeyIdx:lastKeyIdx]
+		left.values = left.values[:lastValueIdx:lastValueIdx]
+
+		n.keys = append([]BTreeKey{key}, n.keys...)
+		n.values = append([]interface{}{value}, n.values...)
+
+		parent.keys[idx-1] = n.keys[0]
+	} else {
+		lastChildIdx := len(left.children) - 1
+		movedChild, err := t.child(left, lastChildIdx)
+		if err != nil {
+			return err
+		}
+
+		n.keys = append([]BTreeKey{parent.keys[idx-1]}, n.keys...)
+		n.children = append([]*treeNode{movedChild}, n.children...)
+		movedChild.parent = n
+		if t.storage != nil {
+			n.childIDs = append([]uint64{movedChild.internalID}, n.childIDs...)
+		}
+
+		parent.keys[idx-1] = left.keys[lastKeyIdx]
+		left.keys = left.keys[:lastKeyIdx:lastKeyIdx]
+		left.children = left.children[:lastChildIdx:lastChildIdx]
+		if t.storage != nil {
+			left.childIDs = left.childIDs[:lastChildIdx:lastChildIdx]
+		}
+	}
+
+	left.dirty = true
+	n.dirty = true
+	parent.dirty = true
+	t.dirty = true
+
+	return nil
+}
+
+func (t *tree) borrowFromRightSibling(n, parent *treeNode, idx int) error {
+	right, err := t.cowChild(parent, idx+1)
+	if err != nil {
+		return err
+	}
+
+	if n.leaf {
+		key := right.keys[0]
+		value := right.values[0]
+
+		right.keys = right.keys[1:len(right.keys):len(right.keys)]
+		right.values = right.values[1:len(right.values):len(right.values)]
+
+		n.keys = append(n.keys, key)
+		n.values = append(n.values, value)
+
+		parent.keys[idx] = right.keys[0]
+	} else {
+		movedChild, err := t.child(right, 0)
+		if err != nil {
+			return err
+		}
+
+		n.keys = append(n.keys, parent.keys[idx])
+		n.children = append(n.children, movedChild)
+		movedChild.parent = n
+		if t.storage != nil {
+			n.childIDs = append(n.childIDs, movedChild.internalID)
+		}
+
+		parent.keys[idx] = right.keys[0]
+		right.keys = right.keys[1:len(right.keys):len(right.keys)]
+		right.children = right.children[1:len(right.children):len(right.children)]
+		if t.storage != nil {
+			right.childIDs = right.childIDs[1:len(right.childIDs):len(right.childIDs)]
+		}
+	}
+
+	right.dirty = true
+	n.dirty = true
+	parent.dirty = true
+	t.dirty = true
+
+	return nil
+}
+
+// mergeSiblings folds right into left, removing the separator key and the
+// right child from parent. For leaves this also splices the previous/next
+// chain so range traversal still visits every remaining key in order.
+func (t *tree) mergeSiblings(left, right, parent *treeNode, leftIdx int) {
+	if left.leaf {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+
+		left.next = right.next
+		if right.next != nil {
+			right.next.previous = left
+			right.next.dirty = true
+		}
+	} else {
+		left.keys = append(left.keys, parent.keys[leftIdx])
+		left.keys = append(left.keys, right.keys...)
+		left.children = append(left.children, right.children...)
+		if t.storage != nil {
+			left.childIDs = append(left.childIDs, right.childIDs...)
+		}
+
+		// An unloaded (nil) child gets its parent set by child() on reload.
+		for _, c := range right.children {
+			if c != nil {
+				c.parent = left
+			}
+		}
+	}
+
+	left.dirty = true
+	parent.dirty = true
+	t.dirty = true
+
+	parent.keys = append(parent.keys[:leftIdx], parent.keys[leftIdx+1:]...)
+	parent.children = append(parent.children[:leftIdx+1], parent.children[leftIdx+2:]...)
+	if t.storage != nil {
+		parent.childIDs = append(parent.childIDs[:leftIdx+1], parent.childIDs[leftIdx+2:]...)
+	}
+
+	// right is now absorbed into left and unreachable from parent, so its
+	// Storage page (if any) can be freed immediately: unlike a CoW clone
+	// cowNode replaces in place, right was already spliced out above with
+	// nothing left to keep it alive, and a pinned Snapshot never reaches it
+	// since right only ever got here via cowChild, which clones it first
+	// whenever one is pinned.
+	if t.cache != nil {
+		t.cache.forget(right.internalID)
+	}
+	if t.storage != nil {
+		t.storage.DeleteNode(right.internalID)
+	}
+}
+
+func (t *tree) search(key BTreeKey) *bTreeTriple {
+	triple := new(bTreeTriple)
+	node, err := t.findNodeForKey(key)
+	if err != nil {
+		triple.err = err
+		return triple
+	}
+
+	if idx := t.findKeyIndex(node, key); idx != -1 {
+		triple.value = node.values[idx]
+	} else {
+		triple.err = ErrNotFound
+	}
+
+	return triple
+}
+
+func (t *tree) findNodeForKey(key BTreeKey) (*treeNode, error) {
 	n := t.root
 
 	for {
 		if n.leaf {
-			return n
+			if t.cache != nil {
+				t.cacheMu.Lock()
+				t.cache.touch(n)
+				t.cacheMu.Unlock()
+			}
+			return n, nil
+		}
+
+		childIdx := len(n.children) - 1
+
+		for idx, k := range n.keys {
+			if t.keyCompare(key, k) == OrderedAscending {
+				childIdx = idx
+				break
+			}
+		}
+
+		var err error
+		n, err = t.child(n, childIdx)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *tree) leftmostLeaf() (*treeNode, error) {
+	n := t.root
+	for !n.leaf {
+		var err error
+		n, err = t.child(n, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func (t *tree) rightmostLeaf() (*treeNode, error) {
+	n := t.root
+	for !n.leaf {
+		var err error
+		n, err = t.child(n, len(n.children)-1)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	return n, nil
+}
+
+// findLeafForKey, leftmostLeafOf and rightmostLeafOf are the Snapshot
+// counterparts of findNodeForKey/leftmostLeaf/rightmostLeaf: they walk a
+// pinned root instead of t.root. Since path-copying CoW (see cowNode)
+// only clones the nodes an operation actually touches, a Snapshot's
+// pinned subtree can still share untouched nodes with the live tree --
+// including leaves houseKeeping may evict -- so these go through
+// t.child() the same way live reads do, rather than indexing children
+// directly, to pick up a lazy reload if Storage is configured.
+func (t *tree) findLeafForKey(root *treeNode, key BTreeKey) (*treeNode, error) {
+	n := root
 
-		var candidateNode *treeNode
+	for !n.leaf {
+		childIdx := len(n.children) - 1
 
 		for idx, k := range n.keys {
 			if t.keyCompare(key, k) == OrderedAscending {
-				candidateNode = n.children[idx]
+				childIdx = idx
 				break
 			}
+		}
+
+		var err error
+		n, err = t.child(n, childIdx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func (t *tree) leftmostLeafOf(root *treeNode) (*treeNode, error) {
+	n := root
+	for !n.leaf {
+		var err error
+		n, err = t.child(n, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func (t *tree) rightmostLeafOf(root *treeNode) (*treeNode, error) {
+	n := root
+	for !n.leaf {
+		var err error
+		n, err = t.child(n, len(n.children)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// newIterator locates the starting leaf/index under the read lock (so it
+// can't race a concurrent mutation) and pins the tree's current version for
+// later invalidation checks.
+func (t *tree) newIterator(reverse bool, lo BTreeKey, hasLo bool, hi BTreeKey, hasHi bool) Iterator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	it := &treeIterator{
+		t:       t,
+		version: t.version,
+		reverse: reverse,
+		hi:      hi,
+		hasHi:   hasHi,
+	}
+
+	var err error
+	switch {
+	case hasLo:
+		it.leaf, err = t.findNodeForKey(lo)
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = 0
+		for it.idx < len(it.leaf.keys) && t.keyCompare(it.leaf.keys[it.idx], lo) == OrderedAscending {
+			it.idx += 1
+		}
+	case reverse:
+		it.leaf, err = t.rightmostLeaf()
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = len(it.leaf.keys) - 1
+	default:
+		it.leaf, err = t.leftmostLeaf()
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = 0
+	}
+
+	return it
+}
+
+// newSnapshotIterator is newIterator's Snapshot counterpart: it walks a
+// pinned root instead of the live tree, and the resulting iterator is
+// pinned (never invalidated). Unlike a live iterator, it steps leaf to
+// leaf by re-descending the pinned root (see ancestorFrame/snapshotDescend)
+// instead of following next/previous: path-copying CoW (cowNode) only
+// guarantees the *structure* reachable from a pinned root stays frozen, not
+// a leaf's next/previous fields, which a later mutation may still rewrite
+// in place on an untouched leaf this Snapshot happens to still share with
+// the live tree.
+func (t *tree) newSnapshotIterator(root *treeNode, reverse bool, lo BTreeKey, hasLo bool, hi BTreeKey, hasHi bool) Iterator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	it := &treeIterator{
+		t:       t,
+		pinned:  true,
+		reverse: reverse,
+		hi:      hi,
+		hasHi:   hasHi,
+	}
+
+	var err error
+	switch {
+	case hasLo:
+		it.leaf, it.stack, err = t.snapshotDescend(root, func(n *treeNode) int {
+			childIdx := len(n.children) - 1
+			for idx, k := range n.keys {
+				if t.keyCompare(lo, k) == OrderedAscending {
+					childIdx = idx
+					break
+				}
+			}
+			return childIdx
+		})
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = 0
+		for it.idx < len(it.leaf.keys) && t.keyCompare(it.leaf.keys[it.idx], lo) == OrderedAscending {
+			it.idx += 1
+		}
+	case reverse:
+		it.leaf, it.stack, err = t.snapshotDescend(root, func(n *treeNode) int { return len(n.children) - 1 })
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = len(it.leaf.keys) - 1
+	default:
+		it.leaf, it.stack, err = t.snapshotDescend(root, func(n *treeNode) int { return 0 })
+		if err != nil {
+			it.err = err
+			return it
+		}
+		it.idx = 0
+	}
+
+	return it
+}
+
+// ancestorFrame is one level of a pinned Snapshot iterator's root-to-leaf
+// path: node is the internal node visited, idx is the index of the child
+// currently descended into.
+type ancestorFrame struct {
+	node *treeNode
+	idx  int
+}
+
+// snapshotDescend walks from root to a leaf, picking the child at each
+// level via pick, and returns the leaf alongside the full path taken so a
+// pinned iterator can later re-descend from any point on it (see
+// snapshotNextLeaf/snapshotPreviousLeaf).
+func (t *tree) snapshotDescend(root *treeNode, pick func(n *treeNode) int) (*treeNode, []ancestorFrame, error) {
+	var stack []ancestorFrame
+	n := root
+
+	for !n.leaf {
+		idx := pick(n)
+		stack = append(stack, ancestorFrame{node: n, idx: idx})
+
+		var err error
+		n, err = t.child(n, idx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return n, stack, nil
+}
+
+// snapshotNextLeaf returns the leaf immediately after the one stack
+// currently points at (and the stack updated to point at it), by popping
+// up to the nearest ancestor with an unvisited child to its right and
+// descending back down its leftmost edge. Returns nil once the stack is
+// exhausted, i.e. the last leaf has already been visited.
+func (t *tree) snapshotNextLeaf(stack []ancestorFrame) (*treeNode, []ancestorFrame, error) {
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+
+		if top.idx+1 >= len(top.node.children) {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		top.idx += 1
+		n, err := t.child(top.node, top.idx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for !n.leaf {
+			stack = append(stack, ancestorFrame{node: n, idx: 0})
+			n, err = t.child(n, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return n, stack, nil
+	}
+
+	return nil, nil, nil
+}
+
+// snapshotPreviousLeaf is snapshotNextLeaf's mirror image, descending each
+// newly-entered subtree's rightmost edge instead of its leftmost one.
+func (t *tree) snapshotPreviousLeaf(stack []ancestorFrame) (*treeNode, []ancestorFrame, error) {
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+
+		if top.idx-1 < 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		top.idx -= 1
+		n, err := t.child(top.node, top.idx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for !n.leaf {
+			idx := len(n.children) - 1
+			stack = append(stack, ancestorFrame{node: n, idx: idx})
+			n, err = t.child(n, idx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return n, stack, nil
+	}
+
+	return nil, nil, nil
+}
+
+// treeSnapshot implements Snapshot by reading through a pinned root. Every
+// read takes the tree's read lock like any other read, so it can't race a
+// concurrent mutation even though it never mutates the pinned subtree
+// itself.
+type treeSnapshot struct {
+	t        *tree
+	version  uint64
+	root     *treeNode
+	released bool
+}
+
+func (s *treeSnapshot) Search(key BTreeKey) (interface{}, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+
+	leaf, err := s.t.findLeafForKey(s.root, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx := s.t.findKeyIndex(leaf, key); idx != -1 {
+		return leaf.values[idx], nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *treeSnapshot) Seek(key BTreeKey) Iterator {
+	return s.t.newSnapshotIterator(s.root, false, key, true, nil, false)
+}
+
+func (s *treeSnapshot) SeekFirst() Iterator {
+	return s.t.newSnapshotIterator(s.root, false, nil, false, nil, false)
+}
+
+func (s *treeSnapshot) SeekLast() Iterator {
+	return s.t.newSnapshotIterator(s.root, true, nil, false, nil, false)
+}
+
+func (s *treeSnapshot) Range(lo, hi BTreeKey) Iterator {
+	return s.t.newSnapshotIterator(s.root, false, lo, true, hi, true)
+}
 
-			candidateNode = n.children[idx+1]
+func (s *treeSnapshot) Min() (BTreeKey, interface{}, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+
+	leaf, err := s.t.leftmostLeafOf(s.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.keys) == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	return leaf.keys[0], leaf.values[0], nil
+}
+
+func (s *treeSnapshot) Max() (BTreeKey, interface{}, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+
+	leaf, err := s.t.rightmostLeafOf(s.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.keys) == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	last := len(leaf.keys) - 1
+	return leaf.keys[last], leaf.values[last], nil
+}
+
+// Release drops this Snapshot's pin on its version. Once every Snapshot on
+// a version is released, the tree resumes mutating nodes in place instead
+// of copy-on-write, so Release should be called as soon as the caller is
+// done with the Snapshot. Releasing also gives reclaimOrphans a chance to
+// free any orphaned subtree that was only kept around for this Snapshot's
+// sake.
+func (s *treeSnapshot) Release() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	if !s.released {
+		s.released = true
+		s.t.refs[s.version] -= 1
+		if s.t.refs[s.version] <= 0 {
+			delete(s.t.refs, s.version)
 		}
+		s.t.reclaimOrphans()
+	}
+}
 
-		n = candidateNode
+// treeIterator walks the leaf-level previous/next chain. All state
+// mutation happens inside step(), which only ever runs while holding the
+// tree's read lock, so it never races Insert/Update/Delete.
+type treeIterator struct {
+	t       *tree
+	version uint64
+	pinned  bool
+	reverse bool
+	leaf    *treeNode
+	idx     int
+	hi      BTreeKey
+	hasHi   bool
+	key     BTreeKey
+	value   interface{}
+	err     error
+	closed  bool
+
+	// stack is only used when pinned: it's the root-to-leaf path
+	// snapshotNextLeaf/snapshotPreviousLeaf re-descend to find the next
+	// leaf, in place of the leaf.next/leaf.previous a live iterator uses.
+	stack []ancestorFrame
+}
+
+func (it *treeIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	it.t.mu.RLock()
+	defer it.t.mu.RUnlock()
+
+	return it.step()
+}
+
+func (it *treeIterator) step() bool {
+	if !it.pinned && it.t.version != it.version {
+		it.err = ErrIteratorInvalidated
+		return false
+	}
+
+	for it.leaf != nil {
+		if it.reverse {
+			if it.idx < 0 {
+				if it.pinned {
+					var err error
+					it.leaf, it.stack, err = it.t.snapshotPreviousLeaf(it.stack)
+					if err != nil {
+						it.err = err
+						return false
+					}
+				} else {
+					it.leaf = it.leaf.previous
+				}
+				if it.leaf != nil {
+					it.idx = len(it.leaf.keys) - 1
+				}
+				continue
+			}
+		} else if it.idx >= len(it.leaf.keys) {
+			if it.pinned {
+				var err error
+				it.leaf, it.stack, err = it.t.snapshotNextLeaf(it.stack)
+				if err != nil {
+					it.err = err
+					return false
+				}
+			} else {
+				it.leaf = it.leaf.next
+			}
+			if it.leaf != nil {
+				it.idx = 0
+			}
+			continue
+		}
+
+		break
+	}
+
+	if it.leaf == nil {
+		return false
 	}
+
+	key := it.leaf.keys[it.idx]
+	value := it.leaf.values[it.idx]
+
+	if it.hasHi && it.t.keyCompare(key, it.hi) == OrderedDescending {
+		it.leaf = nil
+		return false
+	}
+
+	if it.reverse {
+		it.idx -= 1
+	} else {
+		it.idx += 1
+	}
+
+	it.key = key
+	it.value = value
+
+	return true
+}
+
+func (it *treeIterator) Key() BTreeKey {
+	return it.key
+}
+
+func (it *treeIterator) Value() interface{} {
+	return it.value
+}
+
+func (it *treeIterator) Err() error {
+	return it.err
+}
+
+func (it *treeIterator) Close() error {
+	it.closed = true
+	return nil
 }
 
 func (t *tree) recordValue(key BTreeKey, value interface{}, n *treeNode) {
@@ -239,10 +1301,18 @@ func (t *tree) recordValue(key BTreeKey, value interface{}, n *treeNode) {
 		child := value.(*treeNode)
 		if insert == -1 {
 			n.children = append(n.children, child)
+			if t.storage != nil {
+				n.childIDs = append(n.childIDs, child.internalID)
+			}
 		} else {
 			n.children = append(n.children, nil)
 			copy(n.children[insert+1:], n.children[insert:])
 			n.children[insert] = child
+			if t.storage != nil {
+				n.childIDs = append(n.childIDs, 0)
+				copy(n.childIDs[insert+1:], n.childIDs[insert:])
+				n.childIDs[insert] = child.internalID
+			}
 		}
 	} else {
 
@@ -255,6 +1325,9 @@ func (t *tree) recordValue(key BTreeKey, value interface{}, n *treeNode) {
 		}
 	}
 
+	n.dirty = true
+	t.dirty = true
+
 	t.splitNode(n)
 }
 
@@ -276,29 +1349,75 @@ func (t *tree) splitNode(n *treeNode) {
 	}
 
 	sibling := t.newTreeNode(n.leaf)
-	sibling.keys = n.keys[splitPoint:]
-	n.keys = n.keys[:splitPoint]
 
+	// separator is the key that routes to sibling from n's parent. Leaves
+	// keep every key (standard B+ tree: leaves are the source of truth),
+	// so the separator is just a copy of sibling's first key. Internal
+	// nodes hold one fewer key than children, so the key at splitPoint is
+	// promoted to the parent and removed from both halves rather than
+	// copied into either.
+	var separator BTreeKey
+
+	// n's retained half is re-sliced rather than copied, which means it
+	// still shares sibling's backing array unless explicitly capped: a
+	// later append to n (e.g. a merge folding some other sibling into it)
+	// would otherwise grow into sibling's memory and corrupt it while
+	// sibling is still live and reachable elsewhere in the tree. The
+	// three-index slices below cap n's capacity at its own length so any
+	// such append is forced to allocate a fresh backing array instead.
 	if n.leaf {
+		sibling.keys = n.keys[splitPoint:]
+		n.keys = n.keys[:splitPoint:splitPoint]
+		separator = sibling.keys[0]
+
 		sibling.values = n.values[splitPoint:]
-		n.values = n.values[:splitPoint]
+		n.values = n.values[:splitPoint:splitPoint]
 		sibling.previous = n
+		sibling.next = n.next
+		if sibling.next != nil {
+			sibling.next.previous = sibling
+			// sibling.next isn't otherwise touched by this split, so
+			// without marking it dirty here a Storage-backed tree would
+			// never flush its updated previous pointer and a later
+			// evict+reload would resurrect the stale one.
+			sibling.next.dirty = true
+		}
 		n.next = sibling
 	} else {
-		sibling.children = n.children[splitPoint:]
-		n.children = n.children[:splitPoint]
+		separator = n.keys[splitPoint]
+		sibling.keys = n.keys[splitPoint+1:]
+		n.keys = n.keys[:splitPoint:splitPoint]
+
+		sibling.children = n.children[splitPoint+1:]
+		n.children = n.children[:splitPoint+1 : splitPoint+1]
+		for _, c := range sibling.children {
+			if c != nil {
+				c.parent = sibling
+			}
+		}
+		if t.storage != nil {
+			sibling.childIDs = n.childIDs[splitPoint+1:]
+			n.childIDs = n.childIDs[:splitPoint+1 : splitPoint+1]
+		}
 	}
 
+	n.dirty = true
+	sibling.dirty = true
+	t.dirty = true
+
 	if n.parent == nil {
 		root := t.newTreeNode(false)
 		t.root = root
-		root.keys = append(root.keys, sibling.keys[0])
+		root.keys = append(root.keys, separator)
 		root.children = append(root.children, n, sibling)
+		if t.storage != nil {
+			root.childIDs = append(root.childIDs, n.internalID, sibling.internalID)
+		}
 		n.parent = root
 		sibling.parent = root
 	} else {
 		sibling.parent = n.parent
-		t.recordValue(sibling.keys[0], sibling, n.parent)
+		t.recordValue(separator, sibling, n.parent)
 	}
 }
 
@@ -313,13 +1432,326 @@ func (t *tree) newTreeNode(leaf bool) *treeNode {
 	} else {
 		n.children = make([]*treeNode, 0)
 	}
-	n.internalID = t.nodeCount
+
+	if t.storage != nil {
+		n.internalID = t.storage.AllocID()
+	} else {
+		n.internalID = t.nodeCount
+	}
+
 	n.leaf = leaf
 	n.dirty = true
+	// t.version is only bumped at the end of a mutating op, once it fully
+	// commits -- so a node created mid-op belongs to the version that
+	// commit produces, t.version+1, not the version still in progress.
+	// Stamping it with t.version instead would make needsCOW think a
+	// brand new node -- one no Snapshot has ever had a chance to see --
+	// still needs protecting from the very op that just created it.
+	n.owner = t.version + 1
 	t.dirty = true
 
+	if t.cache != nil {
+		t.cache.touch(n)
+	}
+
 	return n
 }
 
+// loadOrCreateRoot reconstitutes the root from Storage if one was saved by
+// a previous session, otherwise starts a fresh tree.
+func (t *tree) loadOrCreateRoot() *treeNode {
+	id, err := t.storage.LoadRoot()
+	if err != nil {
+		root := t.newTreeNode(true)
+		t.storage.SaveRoot(root.internalID)
+		return root
+	}
+
+	root, err := t.loadNode(id)
+	if err != nil {
+		root = t.newTreeNode(true)
+		t.storage.SaveRoot(root.internalID)
+		return root
+	}
+
+	t.cache.touch(root)
+
+	return root
+}
+
+// child returns parent.children[idx], lazily reading it back from Storage
+// if it was evicted. Callers that reach for sibling/child nodes directly
+// (findNodeForKey, rebalance, borrow/merge) go through this rather than
+// indexing children themselves.
+//
+// Mutations always hold t.mu for writing, so at most one goroutine can ever
+// be inside a mutating call at a time. But Search/Range hold only the read
+// lock, and several of those can run concurrently, so the lazy load and
+// cache touch below -- which mutate parent.children and the cache's LRU
+// list -- are serialized through cacheMu to keep concurrent readers from
+// racing each other.
+func (t *tree) child(parent *treeNode, idx int) (*treeNode, error) {
+	t.cacheMu.Lock()
+	defer t.cacheMu.Unlock()
+
+	c := parent.children[idx]
+
+	if c == nil && t.storage != nil {
+		loaded, err := t.loadNode(parent.childIDs[idx])
+		if err != nil {
+			return nil, err
+		}
+
+		loaded.parent = parent
+		parent.children[idx] = loaded
+		c = loaded
+	}
+
+	if t.cache != nil {
+		t.cache.touch(c)
+	}
+
+	return c, nil
+}
+
+// cowEnabled reports whether any Snapshot is currently pinning a version,
+// in which case mutations must clone the nodes they touch rather than
+// mutate them in place.
+func (t *tree) cowEnabled() bool {
+	return len(t.refs) > 0
+}
+
+// maxPinnedVersion returns the highest version any live Snapshot is
+// pinned to, and whether one exists at all.
+func (t *tree) maxPinnedVersion() (uint64, bool) {
+	max, any := uint64(0), false
+
+	for v := range t.refs {
+		if !any || v > max {
+			max = v
+		}
+		any = true
+	}
+
+	return max, any
+}
+
+// needsCOW reports whether n still belongs to a version some live
+// Snapshot might be reading: n.owner <= the highest pinned version means
+// a Snapshot taken at or after n became live could have n reachable from
+// its pinned root, so mutating n in place would corrupt that Snapshot's
+// view. A node created or last cloned after every currently pinned
+// Snapshot was taken is exclusively the live tree's and needs no cloning.
+func (t *tree) needsCOW(n *treeNode) bool {
+	max, any := t.maxPinnedVersion()
+	return any && n.owner <= max
+}
+
+// cowNode returns n unchanged if it doesn't need cloning, otherwise
+// returns a shallow clone of n (its own keys/values or children/childIDs
+// copied into fresh slices, its children's parent pointers repointed at
+// the clone) and records the original as an orphan -- reachable only
+// from whichever Snapshots still pin it -- for reclaimOrphans to free
+// later. Unlike the old whole-tree clone, this only ever copies the one
+// node passed in; callers are responsible for cowing every node along
+// the path they're about to mutate (see cowRoot/cowChild).
+func (t *tree) cowNode(n *treeNode) *treeNode {
+	if !t.needsCOW(n) {
+		return n
+	}
+
+	c := t.newTreeNode(n.leaf)
+	c.keys = append([]BTreeKey(nil), n.keys...)
+	c.parent = n.parent
+
+	if n.leaf {
+		c.values = append([]interface{}(nil), n.values...)
+		c.previous = n.previous
+		c.next = n.next
+		if c.previous != nil {
+			c.previous.next = c
+			// The neighbor's link field just changed in memory; without
+			// marking it dirty, a Storage-backed tree would flush it as
+			// clean and a later evict+reload would resurrect its stale
+			// on-disk sibling pointer, breaking the live leaf chain.
+			c.previous.dirty = true
+		}
+		if c.next != nil {
+			c.next.previous = c
+			c.next.dirty = true
+		}
+	} else {
+		c.children = append([]*treeNode(nil), n.children...)
+		if t.storage != nil {
+			c.childIDs = append([]uint64(nil), n.childIDs...)
+		}
+		for _, child := range c.children {
+			if child != nil {
+				child.parent = c
+			}
+		}
+	}
+
+	if t.cache != nil {
+		t.cache.forget(n.internalID)
+	}
+
+	t.orphaned = append(t.orphaned, orphan{root: n, minVersion: n.owner, atVersion: t.version})
+
+	return c
+}
+
+// cowRoot clones t.root in place if it still needs cloning and returns
+// the (possibly new) root.
+func (t *tree) cowRoot() *treeNode {
+	t.root = t.cowNode(t.root)
+	return t.root
+}
+
+// cowChild is child's copy-on-write counterpart: it returns
+// parent.children[idx] (lazily loading it like child() does), cloning it
+// first if needed, and splicing the clone into parent so the live tree
+// sees it from here on. parent is assumed to already be the live (cowed
+// if necessary) node -- true for anything reached via cowRoot/cowChild.
+func (t *tree) cowChild(parent *treeNode, idx int) (*treeNode, error) {
+	c, err := t.child(parent, idx)
+	if err != nil {
+		return nil, err
+	}
+	clone := t.cowNode(c)
+
+	if clone != c {
+		parent.children[idx] = clone
+		if t.storage != nil {
+			parent.childIDs[idx] = clone.internalID
+		}
+	}
+
+	// clone's parent pointer was copied from c at clone time, which still
+	// references whatever ancestor was live back then -- if that ancestor
+	// has since been cloned itself (e.g. by cowRoot further up this same
+	// descent), parent here is the fresher one and must replace it.
+	clone.parent = parent
+
+	return clone, nil
+}
+
+// cowFindNodeForKey is findNodeForKey's counterpart for mutating
+// operations: it descends the same way, but clones each node it passes
+// through via cowRoot/cowChild instead of reading it as-is, so a pinned
+// Snapshot's view of the untouched original nodes survives the mutation
+// that's about to happen at the leaf this returns.
+func (t *tree) cowFindNodeForKey(key BTreeKey) (*treeNode, error) {
+	n := t.cowRoot()
+
+	for {
+		if n.leaf {
+			if t.cache != nil {
+				t.cacheMu.Lock()
+				t.cache.touch(n)
+				t.cacheMu.Unlock()
+			}
+			return n, nil
+		}
+
+		childIdx := len(n.children) - 1
+
+		for idx, k := range n.keys {
+			if t.keyCompare(key, k) == OrderedAscending {
+				childIdx = idx
+				break
+			}
+		}
+
+		var err error
+		n, err = t.cowChild(n, childIdx)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reclaimOrphans drops orphaned nodes that no longer have any live
+// Snapshot pinned to a version that could still see them -- freeing their
+// Storage backing too when one is configured, otherwise just letting them
+// be garbage collected. Without this, t.orphaned would grow without bound
+// for the plain in-memory case: every CoW clone records an orphan, and
+// Storage is the only thing a Storage-less tree has nothing else to free
+// it from. It's a deliberately simple per-orphan reachability check rather
+// than a full mark-and-sweep over all of Storage: each orphan already
+// knows the exact version range it's reachable from (see cowNode), so no
+// broader scan is needed.
+//
+// Each orphan is exactly one node, not a subtree: cowNode only ever
+// clones the single node it's given, leaving that node's own children
+// (for an internal node) as the same shared pointers the live tree's new
+// clone now also references. Deleting those recursively would delete
+// storage the live tree still depends on -- a child only becomes its own
+// orphan, freeable on its own, if and when some later mutation clones it
+// too.
+func (t *tree) reclaimOrphans() {
+	if len(t.orphaned) == 0 {
+		return
+	}
+
+	kept := t.orphaned[:0]
+
+	for _, o := range t.orphaned {
+		if t.orphanStillPinned(o) {
+			kept = append(kept, o)
+			continue
+		}
+
+		if t.cache != nil {
+			t.cache.forget(o.root.internalID)
+		}
+		if t.storage != nil {
+			t.storage.DeleteNode(o.root.internalID)
+		}
+	}
+
+	t.orphaned = kept
+}
+
+func (t *tree) orphanStillPinned(o orphan) bool {
+	for v := range t.refs {
+		if v >= o.minVersion && v <= o.atVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// houseKeeping flushes dirty nodes through Storage and, once clean, evicts
+// the coldest cached leaves so long-running trees don't have to keep every
+// node resident in RAM.
 func (t *tree) houseKeeping() {
+	if t.storage == nil {
+		return
+	}
+
+	t.flushDirty(t.root)
+	t.storage.SaveRoot(t.root.internalID)
+	t.cache.evictCold(t)
+	t.storage.Sync()
+}
+
+func (t *tree) flushDirty(n *treeNode) {
+	if n == nil {
+		return
+	}
+
+	if n.dirty {
+		data, err := t.encodeNode(n)
+		if err == nil && t.storage.WriteNode(n.internalID, data) == nil {
+			n.dirty = false
+		}
+	}
+
+	if !n.leaf {
+		for _, c := range n.children {
+			t.flushDirty(c)
+		}
+	}
 }
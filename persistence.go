@@ -0,0 +1,549 @@
+package bplustree
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"sync"
+)
+
+// Storage is the persistence boundary a BTree writes dirty nodes through
+// and reads evicted ones back from. Node ids are allocated by the tree via
+// AllocID and are opaque to callers otherwise.
+type Storage interface {
+	ReadNode(id uint64) ([]byte, error)
+	WriteNode(id uint64, data []byte) error
+	DeleteNode(id uint64) error
+	AllocID() uint64
+	Sync() error
+	LoadRoot() (uint64, error)
+	SaveRoot(id uint64) error
+}
+
+// Codec marshals BTreeKeys and values to and from the bytes a Storage
+// persists. Implementations are free to lean on encoding/gob (see
+// NewGobCodec) or supply their own Marshal/Unmarshal funcs via CodecFuncs.
+type Codec interface {
+	MarshalKey(key BTreeKey) ([]byte, error)
+	UnmarshalKey(data []byte) (BTreeKey, error)
+	MarshalValue(value interface{}) ([]byte, error)
+	UnmarshalValue(data []byte) (interface{}, error)
+}
+
+// CodecFuncs adapts four plain funcs into a Codec, for callers who'd rather
+// not declare a named type.
+type CodecFuncs struct {
+	MarshalKeyFunc     func(BTreeKey) ([]byte, error)
+	UnmarshalKeyFunc   func([]byte) (BTreeKey, error)
+	MarshalValueFunc   func(interface{}) ([]byte, error)
+	UnmarshalValueFunc func([]byte) (interface{}, error)
+}
+
+func (c CodecFuncs) MarshalKey(key BTreeKey) ([]byte, error) { return c.MarshalKeyFunc(key) }
+func (c CodecFuncs) UnmarshalKey(data []byte) (BTreeKey, error) {
+	return c.UnmarshalKeyFunc(data)
+}
+func (c CodecFuncs) MarshalValue(value interface{}) ([]byte, error) {
+	return c.MarshalValueFunc(value)
+}
+func (c CodecFuncs) UnmarshalValue(data []byte) (interface{}, error) {
+	return c.UnmarshalValueFunc(data)
+}
+
+// gobCodec marshals keys and values with encoding/gob. Concrete types other
+// than the predeclared Go kinds must be registered with gob.Register before
+// they're used as a key or value, per the encoding/gob documentation.
+type gobCodec struct{}
+
+// NewGobCodec returns the default Codec used when WithStorage is supplied
+// without an explicit WithCodec.
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) MarshalKey(key BTreeKey) ([]byte, error) {
+	return gobEncode(key)
+}
+
+func (gobCodec) UnmarshalKey(data []byte) (BTreeKey, error) {
+	var key interface{}
+	err := gobDecode(data, &key)
+	return key, err
+}
+
+func (gobCodec) MarshalValue(value interface{}) ([]byte, error) {
+	return gobEncode(value)
+}
+
+func (gobCodec) UnmarshalValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := gobDecode(data, &value)
+	return value, err
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(data []byte, v *interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// memoryStorage is an in-memory Storage, mainly useful for tests and for
+// exercising the write-back/eviction path without touching disk.
+type memoryStorage struct {
+	mu      sync.Mutex
+	nodes   map[uint64][]byte
+	nextID  uint64
+	root    uint64
+	hasRoot bool
+}
+
+// NewMemoryStorage returns a Storage that keeps everything in a map.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{nodes: make(map[uint64][]byte)}
+}
+
+func (s *memoryStorage) ReadNode(id uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.nodes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	return out, nil
+}
+
+func (s *memoryStorage) WriteNode(id uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]byte, len(data))
+	copy(out, data)
+	s.nodes[id] = out
+
+	return nil
+}
+
+func (s *memoryStorage) DeleteNode(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, id)
+
+	return nil
+}
+
+func (s *memoryStorage) AllocID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID += 1
+
+	return s.nextID
+}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (s *memoryStorage) LoadRoot() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRoot {
+		return 0, ErrNotFound
+	}
+
+	return s.root, nil
+}
+
+func (s *memoryStorage) SaveRoot(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.root = id
+	s.hasRoot = true
+
+	return nil
+}
+
+const (
+	defaultPageSize        = 4096
+	fileStorageMagic       = uint32(0xB97113E1)
+	fileStorageHeaderBytes = 4 + 8 + 1 + 8 // magic + nextID + hasRoot + rootID
+)
+
+// fileStorage is a Storage backed by one fixed-size page per node. Page 0 is
+// reserved for a header page recording the id allocator and the current
+// root. A node's serialized form must fit in a single page; WriteNode
+// returns an error otherwise, so pageSize needs to be sized for the codec
+// and degree in use.
+type fileStorage struct {
+	mu       sync.Mutex
+	f        *os.File
+	pageSize uint32
+	nextID   uint64
+	root     uint64
+	hasRoot  bool
+}
+
+// NewFileStorage opens (creating if necessary) a single-file, page-oriented
+// store at path. pageSize <= 0 selects a 4KB default.
+func NewFileStorage(path string, pageSize uint32) (Storage, error) {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &fileStorage{f: f, pageSize: pageSize}
+
+	if err := fs.loadHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (s *fileStorage) loadHeader() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		return s.writeHeaderLocked()
+	}
+
+	page := make([]byte, s.pageSize)
+	if _, err := s.f.ReadAt(page, 0); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(page[0:4]) != fileStorageMagic {
+		return ErrNotImplemented
+	}
+
+	s.nextID = binary.BigEndian.Uint64(page[4:12])
+	s.hasRoot = page[12] != 0
+	s.root = binary.BigEndian.Uint64(page[13:21])
+
+	return nil
+}
+
+func (s *fileStorage) writeHeaderLocked() error {
+	page := make([]byte, s.pageSize)
+	binary.BigEndian.PutUint32(page[0:4], fileStorageMagic)
+	binary.BigEndian.PutUint64(page[4:12], s.nextID)
+	if s.hasRoot {
+		page[12] = 1
+	}
+	binary.BigEndian.PutUint64(page[13:21], s.root)
+
+	_, err := s.f.WriteAt(page, 0)
+
+	return err
+}
+
+func (s *fileStorage) pageOffset(id uint64) int64 {
+	return int64(id) * int64(s.pageSize)
+}
+
+func (s *fileStorage) ReadNode(id uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page := make([]byte, s.pageSize)
+	if _, err := s.f.ReadAt(page, s.pageOffset(id)); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(page[0:4])
+	if length == 0 {
+		return nil, ErrNotFound
+	}
+
+	data := make([]byte, length)
+	copy(data, page[4:4+length])
+
+	return data, nil
+}
+
+func (s *fileStorage) WriteNode(id uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uint32(len(data))+4 > s.pageSize {
+		return ErrNotImplemented
+	}
+
+	page := make([]byte, s.pageSize)
+	binary.BigEndian.PutUint32(page[0:4], uint32(len(data)))
+	copy(page[4:], data)
+
+	_, err := s.f.WriteAt(page, s.pageOffset(id))
+
+	return err
+}
+
+// DeleteNode frees id's page by zeroing its length prefix, so a later
+// ReadNode sees it as ErrNotFound. The page itself is left in the file
+// rather than reclaimed by the allocator, which only ever hands out
+// nextID+1 -- trading disk space for a simple, append-only id space.
+func (s *fileStorage) DeleteNode(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page := make([]byte, 4)
+	_, err := s.f.WriteAt(page, s.pageOffset(id))
+
+	return err
+}
+
+func (s *fileStorage) AllocID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID += 1
+	s.writeHeaderLocked()
+
+	return s.nextID
+}
+
+func (s *fileStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Sync()
+}
+
+func (s *fileStorage) LoadRoot() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRoot {
+		return 0, ErrNotFound
+	}
+
+	return s.root, nil
+}
+
+func (s *fileStorage) SaveRoot(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.root = id
+	s.hasRoot = true
+
+	return s.writeHeaderLocked()
+}
+
+const defaultNodeCacheSize = 256
+
+// nodeCache tracks the leaf nodes currently resident in RAM in
+// least-recently-used order, so houseKeeping knows which ones are safe to
+// drop once they've been flushed. Internal (routing) nodes are always kept
+// resident -- they're cheap relative to leaf payloads and descent needs
+// them on every operation, so only leaves are eviction candidates.
+type nodeCache struct {
+	capacity int
+	order    *list.List
+	elems    map[uint64]*list.Element
+}
+
+func newNodeCache(capacity int) *nodeCache {
+	return &nodeCache{
+		capacity: capacity,
+		order:    list.New(),
+		elems:    make(map[uint64]*list.Element),
+	}
+}
+
+func (c *nodeCache) touch(n *treeNode) {
+	if n == nil || !n.leaf {
+		return
+	}
+
+	if el, ok := c.elems[n.internalID]; ok {
+		el.Value = n
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.elems[n.internalID] = c.order.PushFront(n)
+}
+
+// forget removes id from the cache without writing it anywhere, for nodes
+// that have stopped being part of the live tree (see tree.cowNode and
+// tree.mergeSiblings).
+func (c *nodeCache) forget(id uint64) {
+	if el, ok := c.elems[id]; ok {
+		c.order.Remove(el)
+		delete(c.elems, id)
+	}
+}
+
+func (c *nodeCache) evictCold(t *tree) {
+	for c.order.Len() > c.capacity {
+		back := c.order.Back()
+		n := back.Value.(*treeNode)
+
+		if n == t.root {
+			if c.order.Len() <= 1 {
+				break
+			}
+			c.order.MoveToFront(back)
+			continue
+		}
+
+		if n.dirty {
+			if data, err := t.encodeNode(n); err == nil {
+				if t.storage.WriteNode(n.internalID, data) != nil {
+					break
+				}
+				n.dirty = false
+			} else {
+				break
+			}
+		}
+
+		if n.parent != nil {
+			if idx := t.childIndex(n.parent, n); idx >= 0 {
+				n.parent.children[idx] = nil
+			}
+		}
+
+		c.order.Remove(back)
+		delete(c.elems, n.internalID)
+	}
+}
+
+// encodedNode is the on-disk framing for a treeNode: the node's own
+// structure (gob-encoded directly, since ids/flags are plain Go values),
+// wrapping key/value bytes produced by the tree's Codec.
+type encodedNode struct {
+	ID       uint64
+	Leaf     bool
+	Keys     [][]byte
+	Values   [][]byte
+	ChildIDs []uint64
+	NextID   uint64
+	PrevID   uint64
+}
+
+func (t *tree) encodeNode(n *treeNode) ([]byte, error) {
+	en := encodedNode{ID: n.internalID, Leaf: n.leaf}
+
+	for _, k := range n.keys {
+		b, err := t.codec.MarshalKey(k)
+		if err != nil {
+			return nil, err
+		}
+		en.Keys = append(en.Keys, b)
+	}
+
+	if n.leaf {
+		for _, v := range n.values {
+			b, err := t.codec.MarshalValue(v)
+			if err != nil {
+				return nil, err
+			}
+			en.Values = append(en.Values, b)
+		}
+
+		if n.next != nil {
+			en.NextID = n.next.internalID
+		} else {
+			en.NextID = n.nextID
+		}
+
+		if n.previous != nil {
+			en.PrevID = n.previous.internalID
+		} else {
+			en.PrevID = n.prevID
+		}
+	} else {
+		en.ChildIDs = n.childIDs
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&en); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// loadNode decodes a treeNode from Storage. Internal nodes come back with
+// every child slot nil (lazily loaded on demand by t.child). A leaf's
+// next/previous pointers are only reconnected here if the neighbouring leaf
+// is already resident in the cache; otherwise nextID/prevID remain the
+// durable reference and get resolved the next time that neighbour loads.
+func (t *tree) loadNode(id uint64) (*treeNode, error) {
+	data, err := t.storage.ReadNode(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var en encodedNode
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&en); err != nil {
+		return nil, err
+	}
+
+	n := &treeNode{internalID: en.ID, leaf: en.Leaf}
+
+	for _, b := range en.Keys {
+		k, err := t.codec.UnmarshalKey(b)
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, k)
+	}
+
+	if n.leaf {
+		for _, b := range en.Values {
+			v, err := t.codec.UnmarshalValue(b)
+			if err != nil {
+				return nil, err
+			}
+			n.values = append(n.values, v)
+		}
+
+		n.nextID = en.NextID
+		n.prevID = en.PrevID
+
+		if next, ok := t.cache.elems[en.NextID]; en.NextID != 0 && ok {
+			n.next = next.Value.(*treeNode)
+			n.next.previous = n
+		}
+		if prev, ok := t.cache.elems[en.PrevID]; en.PrevID != 0 && ok {
+			n.previous = prev.Value.(*treeNode)
+			n.previous.next = n
+		}
+	} else {
+		n.childIDs = en.ChildIDs
+		n.children = make([]*treeNode, len(en.ChildIDs))
+	}
+
+	if t.cache != nil {
+		t.cache.touch(n)
+	}
+
+	return n, nil
+}